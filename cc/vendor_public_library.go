@@ -0,0 +1,110 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cc
+
+import (
+	"sort"
+	"sync"
+
+	"android/soong/android"
+)
+
+func init() {
+	android.RegisterModuleType("vendor_public_library", vendorPublicLibraryFactory)
+}
+
+var (
+	vendorPublicLibraries     []string
+	vendorPublicLibrariesLock sync.Mutex
+)
+
+// vendorPublicLibraryProperties are the properties of a vendor_public_library
+// module: a platform (/system) library that wants to expose a stable subset
+// of its API to non-VNDK vendor modules without becoming VNDK itself.
+type vendorPublicLibraryProperties struct {
+	// Relative path to the symbol map (.map.txt) that lists the subset of the
+	// real library's API surface exposed to vendor modules.
+	Symbol_file *string
+
+	// whether the stub library built from `symbol_file` exposes every listed
+	// symbol unversioned instead of carrying the version scopes of the map
+	// file. Defaults to false.
+	Unversioned *bool
+}
+
+// vendorPublicLibraryStubDecorator builds a stubs-only shared library from a
+// `.map.txt` symbol file, similar to llndkStubDecorator. Non-VNDK vendor
+// modules link against the stub at build time; at runtime they dlopen the
+// real implementation from /system, so the stub itself is never installed.
+type vendorPublicLibraryStubDecorator struct {
+	*libraryDecorator
+
+	Properties        vendorPublicLibraryProperties
+	versionScriptPath android.ModuleGenPath
+}
+
+func (stub *vendorPublicLibraryStubDecorator) compilerFlags(ctx ModuleContext, flags Flags, deps PathDeps) Flags {
+	flags = stub.libraryDecorator.compilerFlags(ctx, flags, deps)
+	flags.Global.CFlags = append([]string{"-DANDROID_VENDOR_PUBLIC_LIBRARY_STUB"}, flags.Global.CFlags...)
+	return flags
+}
+
+func (stub *vendorPublicLibraryStubDecorator) compile(ctx ModuleContext, flags Flags, deps PathDeps) Objects {
+	objs, versionScript := compileStubLibrary(ctx, flags, String(stub.Properties.Symbol_file), "current", "--vendor-public")
+	stub.versionScriptPath = versionScript
+	return objs
+}
+
+func (stub *vendorPublicLibraryStubDecorator) link(ctx ModuleContext, flags Flags, deps PathDeps, objs Objects) android.Path {
+	if !Bool(stub.Properties.Unversioned) {
+		stub.libraryDecorator.versionScriptPath = stub.versionScriptPath
+	}
+	return stub.libraryDecorator.link(ctx, flags, deps, objs)
+}
+
+// install is a no-op: the stub is consumed at build time only, the real
+// library that backs it already lives on /system.
+func (stub *vendorPublicLibraryStubDecorator) install(ctx ModuleContext, path android.Path) {
+}
+
+func vendorPublicLibraryFactory() android.Module {
+	module, library := NewLibrary(android.DeviceSupported)
+	library.BuildOnlyShared()
+	module.stl = nil
+	module.sanitize = nil
+	library.StripProperties.Strip.None = BoolPtr(true)
+
+	stub := &vendorPublicLibraryStubDecorator{
+		libraryDecorator: library,
+	}
+	module.compiler = stub
+	module.linker = stub
+	module.installer = stub
+
+	module.AddProperties(&stub.Properties)
+	android.AddLoadHook(module, func(ctx android.LoadHookContext) {
+		registerVendorPublicLibrary(ctx.ModuleName())
+	})
+	return module.Init()
+}
+
+func registerVendorPublicLibrary(name string) {
+	vendorPublicLibrariesLock.Lock()
+	defer vendorPublicLibrariesLock.Unlock()
+	if !inList(name, vendorPublicLibraries) {
+		vendorPublicLibraries = append(vendorPublicLibraries, name)
+		sort.Strings(vendorPublicLibraries)
+	}
+}
@@ -15,13 +15,56 @@
 package cc
 
 import (
+	"encoding/json"
 	"sort"
 	"strings"
 	"sync"
 
 	"android/soong/android"
+
+	"github.com/google/blueprint/proptools"
 )
 
+func init() {
+	android.RegisterSingletonType("vndk-snapshot", vndkSnapshotSingletonFunc)
+	android.PreDepsMutators(func(ctx android.RegisterMutatorsContext) {
+		// image_product must run in the same pass as (and after) the
+		// pre-existing vendor/VNDK image mutator, so that useVndk() already
+		// reflects whether this variant is the vendor one before we decide
+		// whether to split off a /product sibling.
+		ctx.BottomUp("image_product", productVariantMutator).Parallel()
+	})
+	android.PostDepsMutators(func(ctx android.RegisterMutatorsContext) {
+		// vndk_ext must run after the (pre-existing) "vndk" mutator that adds
+		// the vndkExtDepTag edge via vndkGatherLibraryLists, so the edge is
+		// already resolved and walkable by the time this runs.
+		ctx.BottomUp("vndk_ext", vndkExtMutator).Parallel()
+	})
+}
+
+// productVariantMutator creates the /product partition variant for modules
+// that set `product_available: true`, mirroring how the vendor/VNDK image
+// variant is created. It is gated on !useVndk() so that it only ever splits
+// a module's core lineage, never the already-created vendor variant, which
+// would otherwise produce a bogus fourth "vendor+product" variant instead of
+// three independent core/vendor/product siblings.
+func productVariantMutator(mctx android.BottomUpMutatorContext) {
+	m, ok := mctx.Module().(*Module)
+	if !ok || !m.isProduct() || m.useVndk() {
+		return
+	}
+	if _, ok := m.linker.(libraryInterface); !ok {
+		return
+	}
+
+	mods := mctx.CreateVariations("", "product")
+	product := mods[1].(*Module)
+	product.Properties.UseProduct = true
+	if err := proptools.AppendMatchingProperties(product.compiler.compilerProps(), &product.ProductProperties.Target.Product, nil); err != nil {
+		mctx.ModuleErrorf("failed to apply target.product properties: %s", err)
+	}
+}
+
 type VndkProperties struct {
 	Vndk struct {
 		// declared as a VNDK or VNDK-SP module. The vendor variant
@@ -42,6 +85,29 @@ type VndkProperties struct {
 		// the module is VNDK-core and can link to other VNDK-core,
 		// VNDK-SP or LL-NDK modules only.
 		Support_system_process *bool
+
+		// the name of the VNDK (or VNDK-SP) module that this module extends. The
+		// module becomes a VNDK-ext (or VNDK-SP-ext, when the base module has
+		// `support_system_process` set) and inherits the ABI of the named base
+		// module while shipping a vendor-customized implementation.
+		//
+		// The base module must be `vendor_available: true` and, when set, must
+		// share the same `support_system_process` value as this module.
+		Extends *string
+	}
+}
+
+// ProductProperties is the `/product` partition counterpart of
+// VendorProperties: a module that sets `product_available: true` gets an
+// extra variant compiled and installed to /product/lib[64], alongside its
+// core (and, if requested, vendor) variants.
+type ProductProperties struct {
+	// whether this module is available to /product/lib[64].
+	Product_available *bool
+
+	// Properties for the /product variant, analogous to `target.vendor`.
+	Target struct {
+		Product ImageVariantProperties
 	}
 }
 
@@ -67,21 +133,74 @@ func (vndk *vndkdep) isVndkSp() bool {
 	return Bool(vndk.Properties.Vndk.Support_system_process)
 }
 
+func (vndk *vndkdep) isVndkExt() bool {
+	return vndk.Properties.Vndk.Extends != nil
+}
+
+func (vndk *vndkdep) getVndkExtendsModuleName() string {
+	return String(vndk.Properties.Vndk.Extends)
+}
+
 func (vndk *vndkdep) typeName() string {
 	if !vndk.isVndk() {
 		return "native:vendor"
 	}
 	if !vndk.isVndkSp() {
-		return "native:vendor:vndk"
+		if !vndk.isVndkExt() {
+			return "native:vendor:vndk"
+		}
+		return "native:vendor:vndkext"
+	}
+	if !vndk.isVndkExt() {
+		return "native:vendor:vndksp"
 	}
-	return "native:vendor:vndksp"
+	return "native:vendor:vndkspext"
 }
 
-func (vndk *vndkdep) vndkCheckLinkType(ctx android.ModuleContext, to *Module) {
+// isProduct returns whether this module sets `product_available`. It is true
+// for every variant of such a module; use useProduct() to tell whether this
+// is the /product variant itself.
+func (c *Module) isProduct() bool {
+	return Bool(c.ProductProperties.Product_available)
+}
+
+// useProduct returns whether the image variant mutator selected this module's
+// /product variant, analogous to useVndk() for the /vendor variant.
+func (c *Module) useProduct() bool {
+	return c.Properties.UseProduct
+}
+
+func (vndk *vndkdep) vndkCheckLinkType(ctx android.ModuleContext, from *Module, to *Module, tag dependencyTag) {
 	if to.linker == nil {
 		return
 	}
+	if tag == headerDepTag {
+		// Header-only dependencies are not linked into the resulting binary and so
+		// are exempt from VNDK link-type checks.
+		return
+	}
+	if from.useProduct() {
+		// Product partition modules may not link to vendor-only libraries; they
+		// may only link to VNDK, LL-NDK, or other product_available libraries.
+		// Only shared library dependencies are checked.
+		lib, isLib := to.linker.(*libraryDecorator)
+		prebuiltLib, isPrebuiltLib := to.linker.(*prebuiltLibraryLinker)
+		isSharedLib := (isLib && lib.shared()) || (isPrebuiltLib && prebuiltLib.shared())
+		if isSharedLib {
+			if (to.vndkdep == nil || !to.vndkdep.isVndk()) && !to.isProduct() {
+				ctx.ModuleErrorf("(native:product) should not link to %q which is not a product-available library", to.Name())
+			}
+		}
+		return
+	}
 	if !vndk.isVndk() {
+		if _, ok := to.linker.(*vendorPublicLibraryStubDecorator); ok {
+			// vendor_public_library stubs expose a stable subset of a /system
+			// library's API to vendor modules; the real implementation behind
+			// the stub is never vendor_available, but the stub itself is
+			// always a valid dependency for a vendor module.
+			return
+		}
 		// Non-VNDK modules (those installed to /vendor) can't depend on modules marked with
 		// vendor_available: false.
 		violation := false
@@ -112,11 +231,24 @@ func (vndk *vndkdep) vndkCheckLinkType(ctx android.ModuleContext, to *Module) {
 	if to.vndkdep == nil {
 		return
 	}
-	if (vndk.isVndk() && !to.vndkdep.isVndk()) || (vndk.isVndkSp() && !to.vndkdep.isVndkSp()) {
-		ctx.ModuleErrorf("(%s) should not link to %q(%s)",
-			vndk.typeName(), to.Name(), to.vndkdep.typeName())
-		return
+	if vndk.isVndkSp() {
+		// VNDK-SP and VNDK-SP-ext may depend only on other VNDK-SP libs (LL-NDK
+		// libs are handled above since they never use *libraryDecorator).
+		if !to.vndkdep.isVndk() || !to.vndkdep.isVndkSp() {
+			ctx.ModuleErrorf("(%s) should not link to %q(%s)",
+				vndk.typeName(), to.Name(), to.vndkdep.typeName())
+			return
+		}
+	} else if vndk.isVndk() && !vndk.isVndkExt() {
+		// VNDK-core may depend only on other VNDK (core or SP) libs.
+		if !to.vndkdep.isVndk() {
+			ctx.ModuleErrorf("(%s) should not link to %q(%s)",
+				vndk.typeName(), to.Name(), to.vndkdep.typeName())
+			return
+		}
 	}
+	// VNDK-ext libs may additionally depend on VNDK-core, VNDK-SP and other
+	// vendor libs, so no further restriction applies to them here.
 }
 
 var (
@@ -125,53 +257,210 @@ var (
 	llndkLibraries       []string
 	vndkPrivateLibraries []string
 	vndkLibrariesLock    sync.Mutex
+
+	// dependency tag for the edge from a VNDK-ext (or VNDK-SP-ext) module to
+	// the VNDK (or VNDK-SP) module it extends. A later mutator/singleton walks
+	// this edge to verify the base module exists, that it is
+	// `vendor_available: true`, and that the two modules agree on
+	// `support_system_process`.
+	vndkExtDepTag = dependencyTag{name: "vndk extends"}
 )
 
 // gather list of vndk-core, vndk-sp, and ll-ndk libs
 func vndkMutator(mctx android.BottomUpMutatorContext) {
-	if m, ok := mctx.Module().(*Module); ok {
-		if lib, ok := m.linker.(*llndkStubDecorator); ok {
-			vndkLibrariesLock.Lock()
-			defer vndkLibrariesLock.Unlock()
-			name := strings.TrimSuffix(m.Name(), llndkLibrarySuffix)
-			if !inList(name, llndkLibraries) {
-				llndkLibraries = append(llndkLibraries, name)
-				sort.Strings(llndkLibraries)
-			}
-			if !lib.Properties.Vendor_available {
-				if !inList(name, vndkPrivateLibraries) {
-					vndkPrivateLibraries = append(vndkPrivateLibraries, name)
-					sort.Strings(vndkPrivateLibraries)
-				}
+	m, ok := mctx.Module().(*Module)
+	if !ok {
+		return
+	}
+	vndkGatherLibraryLists(mctx, m)
+}
+
+func vndkGatherLibraryLists(mctx android.BottomUpMutatorContext, m *Module) {
+	if m.vndkdep != nil && m.vndkdep.isVndkExt() {
+		mctx.AddVariationDependencies(nil, vndkExtDepTag, m.vndkdep.getVndkExtendsModuleName())
+	}
+	if m.useProduct() {
+		// The /product variant never contributes to the VNDK library lists;
+		// only its core/vendor siblings do.
+		return
+	}
+	if lib, ok := m.linker.(*llndkStubDecorator); ok {
+		vndkLibrariesLock.Lock()
+		defer vndkLibrariesLock.Unlock()
+		name := strings.TrimSuffix(m.Name(), llndkLibrarySuffix)
+		if !inList(name, llndkLibraries) {
+			llndkLibraries = append(llndkLibraries, name)
+			sort.Strings(llndkLibraries)
+		}
+		if !lib.Properties.Vendor_available {
+			if !inList(name, vndkPrivateLibraries) {
+				vndkPrivateLibraries = append(vndkPrivateLibraries, name)
+				sort.Strings(vndkPrivateLibraries)
 			}
-		} else {
-			lib, is_lib := m.linker.(*libraryDecorator)
-			prebuilt_lib, is_prebuilt_lib := m.linker.(*prebuiltLibraryLinker)
-			if (is_lib && lib.shared()) || (is_prebuilt_lib && prebuilt_lib.shared()) {
-				name := strings.TrimPrefix(m.Name(), "prebuilt_")
-				if m.vndkdep.isVndk() {
-					vndkLibrariesLock.Lock()
-					defer vndkLibrariesLock.Unlock()
-					if m.vndkdep.isVndkSp() {
-						if !inList(name, vndkSpLibraries) {
-							vndkSpLibraries = append(vndkSpLibraries, name)
-							sort.Strings(vndkSpLibraries)
-						}
-					} else {
-						if !inList(name, vndkCoreLibraries) {
-							vndkCoreLibraries = append(vndkCoreLibraries, name)
-							sort.Strings(vndkCoreLibraries)
-						}
+		}
+	} else {
+		lib, is_lib := m.linker.(*libraryDecorator)
+		prebuilt_lib, is_prebuilt_lib := m.linker.(*prebuiltLibraryLinker)
+		if (is_lib && lib.shared()) || (is_prebuilt_lib && prebuilt_lib.shared()) {
+			name := strings.TrimPrefix(m.Name(), "prebuilt_")
+			if m.vndkdep.isVndk() && !m.vndkdep.isVndkExt() {
+				vndkLibrariesLock.Lock()
+				defer vndkLibrariesLock.Unlock()
+				if m.vndkdep.isVndkSp() {
+					if !inList(name, vndkSpLibraries) {
+						vndkSpLibraries = append(vndkSpLibraries, name)
+						sort.Strings(vndkSpLibraries)
+					}
+				} else {
+					if !inList(name, vndkCoreLibraries) {
+						vndkCoreLibraries = append(vndkCoreLibraries, name)
+						sort.Strings(vndkCoreLibraries)
 					}
-					if !Bool(m.VendorProperties.Vendor_available) {
-						if !inList(name, vndkPrivateLibraries) {
-							vndkPrivateLibraries = append(vndkPrivateLibraries, name)
-							sort.Strings(vndkPrivateLibraries)
-						}
+				}
+				if !Bool(m.VendorProperties.Vendor_available) {
+					if !inList(name, vndkPrivateLibraries) {
+						vndkPrivateLibraries = append(vndkPrivateLibraries, name)
+						sort.Strings(vndkPrivateLibraries)
 					}
 				}
 			}
 		}
+	}
+}
+
+// vndkExtMutator runs after vndkMutator has resolved the `vndkExtDepTag` edge
+// added for every VNDK-ext (or VNDK-SP-ext) module, and validates that the
+// extended base module actually exists, is `vendor_available: true`, and
+// agrees with the extending module on `support_system_process`.
+func vndkExtMutator(mctx android.BottomUpMutatorContext) {
+	m, ok := mctx.Module().(*Module)
+	if !ok || m.vndkdep == nil || !m.vndkdep.isVndkExt() {
+		return
+	}
+
+	baseName := m.vndkdep.getVndkExtendsModuleName()
+	found := false
+	mctx.VisitDirectDepsWithTag(vndkExtDepTag, func(dep android.Module) {
+		found = true
+		base, ok := dep.(*Module)
+		if !ok || base.vndkdep == nil || !base.vndkdep.isVndk() {
+			mctx.ModuleErrorf("vndk.extends %q which is not a VNDK or VNDK-SP library", baseName)
+			return
+		}
+		if !Bool(base.VendorProperties.Vendor_available) {
+			mctx.ModuleErrorf("vndk.extends %q which is not vendor_available", baseName)
+		}
+		if m.vndkdep.isVndkSp() != base.vndkdep.isVndkSp() {
+			mctx.ModuleErrorf("vndk.extends %q but support_system_process (%t) does not match the base module's (%t)",
+				baseName, m.vndkdep.isVndkSp(), base.vndkdep.isVndkSp())
+		}
+	})
+	if !found {
+		mctx.ModuleErrorf("vndk.extends %q: no such VNDK module", baseName)
+	}
+}
+
+// vndkSnapshotLibrary is one entry of the VNDK snapshot manifest, describing
+// everything a downstream vendor needs to freeze and later diff a VNDK
+// library without re-parsing Soong internals.
+type vndkSnapshotLibrary struct {
+	Name                 string `json:"name"`
+	InstalledPath        string `json:"installed_path"`
+	Soname               string `json:"soname"`
+	SupportSystemProcess bool   `json:"support_system_process"`
+	VendorAvailable      bool   `json:"vendor_available"`
+	Extends              string `json:"extends,omitempty"`
+}
+
+// vndkSnapshotManifest is the top-level shape of the manifest written to
+// $OUT/vndk-snapshot/<VNDK_VERSION>/vndk_snapshot.json.
+type vndkSnapshotManifest struct {
+	VndkCore    []string              `json:"vndk_core"`
+	VndkSp      []string              `json:"vndk_sp"`
+	Llndk       []string              `json:"llndk"`
+	VndkPrivate []string              `json:"vndk_private"`
+	Libraries   []vndkSnapshotLibrary `json:"libraries"`
+}
+
+// vndkSnapshotSingleton runs after vndkMutator has finished collecting the
+// VNDK library lists and emits a machine-readable manifest that `make vndk`
+// packages into a redistributable snapshot tarball.
+type vndkSnapshotSingleton struct {
+	manifestPath android.OutputPath
+}
 
+func vndkSnapshotSingletonFunc() android.Singleton {
+	return &vndkSnapshotSingleton{}
+}
+
+func (c *vndkSnapshotSingleton) GenerateBuildActions(ctx android.SingletonContext) {
+	vndkLibrariesLock.Lock()
+	defer vndkLibrariesLock.Unlock()
+
+	manifest := vndkSnapshotManifest{
+		VndkCore:    append([]string(nil), vndkCoreLibraries...),
+		VndkSp:      append([]string(nil), vndkSpLibraries...),
+		Llndk:       append([]string(nil), llndkLibraries...),
+		VndkPrivate: append([]string(nil), vndkPrivateLibraries...),
+	}
+
+	ctx.VisitAllModules(func(module android.Module) {
+		m, ok := module.(*Module)
+		if !ok || m.vndkdep == nil || !m.vndkdep.isVndk() || m.useProduct() {
+			return
+		}
+		lib, isLib := m.linker.(*libraryDecorator)
+		prebuiltLib, isPrebuiltLib := m.linker.(*prebuiltLibraryLinker)
+		if !((isLib && lib.shared()) || (isPrebuiltLib && prebuiltLib.shared())) {
+			return
+		}
+
+		name := strings.TrimPrefix(m.Name(), "prebuilt_")
+		libDir := "lib"
+		if m.Arch().ArchType.Multilib == "lib64" {
+			libDir = "lib64"
+		}
+		partitionDir := "vndk"
+		if m.vndkdep.isVndkSp() {
+			partitionDir = "vndk-sp"
+		}
+		partition := "system"
+		if m.vndkdep.isVndkExt() {
+			partition = "vendor"
+		}
+
+		entry := vndkSnapshotLibrary{
+			Name:                 name,
+			InstalledPath:        "/" + partition + "/" + libDir + "/" + partitionDir + "/" + name + ".so",
+			Soname:               name + ".so",
+			SupportSystemProcess: m.vndkdep.isVndkSp(),
+			VendorAvailable:      Bool(m.VendorProperties.Vendor_available),
+		}
+		if m.vndkdep.isVndkExt() {
+			entry.Extends = m.vndkdep.getVndkExtendsModuleName()
+		}
+		manifest.Libraries = append(manifest.Libraries, entry)
+	})
+
+	sort.Slice(manifest.Libraries, func(i, j int) bool {
+		return manifest.Libraries[i].Name < manifest.Libraries[j].Name
+	})
+
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		ctx.Errorf("failed to marshal VNDK snapshot manifest: %s", err)
+		return
+	}
+
+	c.manifestPath = android.PathForOutput(ctx, "vndk-snapshot", ctx.DeviceConfig().VndkVersion(), "vndk_snapshot.json")
+	android.WriteFileRule(ctx, c.manifestPath, string(content))
+}
+
+// MakeVars exposes the manifest path to Android.mk so that `make vndk` can
+// bundle it into the VNDK snapshot tarball.
+func (c *vndkSnapshotSingleton) MakeVars(ctx android.MakeVarsContext) {
+	if c.manifestPath == nil {
+		return
 	}
+	ctx.Strict("SOONG_VNDK_SNAPSHOT_MANIFEST", c.manifestPath.String())
 }